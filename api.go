@@ -1,19 +1,22 @@
 package reflink
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 )
 
 // Always will perform a reflink operation and fail on error.
 //
 // This is equivalent to command cp --reflink=always
 func Always(src, dst string) error {
-	return reflinkFile(src, dst, false)
+	return reflinkFile(src, dst, Options{})
 }
 
 // Auto will attempt to perform a reflink operation and fallback to normal data
@@ -21,72 +24,220 @@ func Always(src, dst string) error {
 //
 // This is equivalent to cp --reflink=auto
 func Auto(src, dst string) error {
-	return reflinkFile(src, dst, true)
+	return reflinkFile(src, dst, Options{Fallback: true})
+}
+
+// Options allows tweaking the behavior of ReflinkWithOptions.
+type Options struct {
+	// Fallback enables falling back to copy_file_range then io.Copy if reflink
+	// fails, similar to Auto.
+	Fallback bool
+
+	// DryRun will not copy anything, but instead return a DryRunResult
+	// describing which copy method would be used.
+	DryRun bool
+
+	// Lock acquires an exclusive advisory lock on a ".lock" sidecar file next
+	// to the destination for the duration of the copy. The sidecar file is left
+	// in place afterwards. If the lock is held by someone else,
+	// ErrLockContested is returned. Advisory locks only protect against
+	// writers that use the same locking convention. Locking is only
+	// implemented on Linux, other OSes return ErrReflinkUnsupported.
+	Lock bool
+}
+
+// ReflinkWithOptions copies src into dst according to the passed options. A
+// non-nil DryRunResult is returned only if opts.DryRun is set, in which case
+// no file is modified. If opts.Fallback is not set and reflink is not possible,
+// a dry run returns ErrReflinkFailed, same as the actual copy would.
+func ReflinkWithOptions(src, dst string, opts Options) (*DryRunResult, error) {
+	if opts.DryRun {
+		m, err := PredictMethod(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.Fallback && m != MethodReflink && m != MethodHardlink {
+			return nil, ErrReflinkFailed
+		}
+		return &DryRunResult{Src: src, Dst: dst, Method: m}, nil
+	}
+	return nil, reflinkFile(src, dst, opts)
 }
 
 // reflinkFile perform the reflink operation in order to copy src into dst using
 // the underlying filesystem's copy-on-write reflink system. If this fails (for
-// example the filesystem does not support reflink) and fallback is true, then
-// copy_file_range will be used, and if that fails too io.Copy will be used to
-// copy the data.
-func reflinkFile(src, dst string, fallback bool) error {
+// example the filesystem does not support reflink) and opts.Fallback is true, then
+// copy_file_range will be used, followed by sendfile, and if that fails too
+// io.Copy will be used to copy the data.
+func reflinkFile(src, dst string, opts Options) error {
 	s, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
+	_, err = reflinkFrom(s, dst, opts)
+	return err
+}
+
+// reflinkFrom copies the already opened file s into dst, and returns the
+// number of bytes copied. s's file offset is not used, which means the same
+// file can be used for multiple concurrent calls.
+func reflinkFrom(s *os.File, dst string, opts Options) (int64, error) {
+	st, err := s.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.Lock {
+		unlock, err := lockDestination(dst)
+		if err != nil {
+			return 0, err
+		}
+		defer unlock()
+	}
+
+	// if dst already is the same file as s, there is nothing to copy
+	linked, err := alreadyLinked(st, dst)
+	if err != nil {
+		return 0, err
+	}
+	if linked {
+		return st.Size(), nil
+	}
+
 	// generate temporary file for output
 	tmp, err := ioutil.TempFile(filepath.Dir(dst), "")
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	// make sure rename will not fail because of a mount mismatch before copying anything
+	err = checkSameMount(tmp, dst)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
 	}
 
 	// copy to temp file
+	var n int64
 	err = reflinkInternal(tmp, s)
+	if err == nil {
+		n = st.Size()
+	}
 
 	// if reflink failed but we allow fallback, first attempt using copyFileRange (will actually clone bytes on some filesystems)
-	if (err != nil) && fallback {
-		var st fs.FileInfo
-		st, err = s.Stat()
-		if err == nil {
-			_, err = copyFileRange(tmp, s, 0, 0, st.Size())
+	if (err != nil) && opts.Fallback {
+		n, err = copyFileRange(tmp, s, 0, 0, st.Size())
+		if err != nil {
+			// copyFileRange failed, attempt sendfile
+			n, err = sendFileCopy(tmp, s, 0, 0, st.Size())
 		}
 	}
 
 	// if everything failed and we fallback, attempt io.Copy
-	if (err != nil) && fallback {
+	if (err != nil) && opts.Fallback {
 		// reflink failed but fallback enabled, perform a normal copy instead
-		_, err = io.Copy(tmp, s)
+		// from the start of the file, discarding anything partially copied
+		tmp.Truncate(0)
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err == nil {
+			// reserve disk space first so we fail early if there isn't enough
+			err = preallocate(tmp, st.Size())
+		}
+		if err == nil {
+			n, err = io.Copy(tmp, io.NewSectionReader(s, 0, st.Size()))
+		}
 	}
 	tmp.Close() // we're not writing to this anymore
 
+	if err == nil && n != st.Size() {
+		err = fmt.Errorf("short copy: copied %d bytes out of %d", n, st.Size())
+	}
+
 	// if an error happened, remove temp file and signal error
 	if err != nil {
 		os.Remove(tmp.Name())
-		return err
+		return 0, err
 	}
 
 	// keep src file mode if possible
-	if st, err := s.Stat(); err == nil {
-		tmp.Chmod(st.Mode())
-	}
+	tmp.Chmod(st.Mode())
 
 	// replace dst file
 	err = os.Rename(tmp.Name(), dst)
 	if err != nil {
 		// failed to rename (dst is not writable?)
 		os.Remove(tmp.Name())
-		return err
+		return 0, err
 	}
 
-	return nil
+	return n, nil
+}
+
+// FanOutResult is the result of copying to a single destination in AutoN.
+type FanOutResult struct {
+	Dst         string
+	BytesCopied int64
+	Err         error
+}
+
+// AutoN copies src to all of dsts in parallel, similar to calling Auto for
+// each destination, except src is only opened once. Up to concurrency copies
+// are performed at the same time. If concurrency is zero or less,
+// runtime.NumCPU() is used.
+//
+// The returned slice has one entry per destination, in the same order as dsts,
+// allowing callers to retry only the failed destinations.
+func AutoN(src string, dsts []string, concurrency int) []FanOutResult {
+	res := make([]FanOutResult, len(dsts))
+	for i, dst := range dsts {
+		res[i].Dst = dst
+	}
+
+	s, err := os.Open(src)
+	if err != nil {
+		for i := range res {
+			res[i].Err = err
+		}
+		return res
+	}
+	defer s.Close()
+
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+	if concurrency > len(dsts) {
+		concurrency = len(dsts)
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res[i].BytesCopied, res[i].Err = reflinkFrom(s, res[i].Dst, Options{Fallback: true})
+			}
+		}()
+	}
+
+	for i := range dsts {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return res
 }
 
 // Reflink performs the reflink operation on the passed files, replacing
 // dst's contents with src. If fallback is true and reflink fails,
-// copy_file_range will be used first, and if that fails too io.Copy will
-// be used to copy the data.
+// copy_file_range will be used first, followed by sendfile, and if that fails
+// too io.Copy will be used to copy the data. dst's file offset is left
+// unchanged.
 func Reflink(dst, src *os.File, fallback bool) error {
 	err := reflinkInternal(dst, src)
 	if (err != nil) && fallback {
@@ -99,11 +250,20 @@ func Reflink(dst, src *os.File, fallback bool) error {
 		}
 		_, err = copyFileRange(dst, src, 0, 0, st.Size())
 		if err != nil {
-			// copyFileRange failed too, switch to simple io copy
+			// copyFileRange failed too, attempt sendfile
+			_, err = sendFileCopy(dst, src, 0, 0, st.Size())
+		}
+		if err != nil {
+			// sendfile failed too, switch to simple io copy
 			reader := io.NewSectionReader(src, 0, st.Size())
 			writer := &sectionWriter{w: dst}
-			dst.Truncate(0) // assuming any error in trucate will result in copy error
-			_, err = io.Copy(writer, reader)
+			// reserve disk space before touching dst's contents so running out
+			// of space leaves it intact, then cut anything past the new size
+			err = preallocate(dst, st.Size())
+			if err == nil {
+				dst.Truncate(st.Size()) // assuming any error in trucate will result in copy error
+				_, err = io.Copy(writer, reader)
+			}
 		}
 	}
 	return err
@@ -127,3 +287,45 @@ func Partial(dst, src *os.File, dstOffset, srcOffset, n int64, fallback bool) er
 	}
 	return err
 }
+
+// FileInfo holds extent sharing statistics for a file, as returned by
+// ReflinkInfo.
+type FileInfo struct {
+	TotalExtents   int
+	SharedExtents  int
+	PrivateExtents int
+	SharedBytes    uint64
+	PrivateBytes   uint64
+}
+
+// mountIDOf returns the mount ID of a path, and is a variable so tests can
+// replace it.
+var mountIDOf = mountID
+
+// checkSameMount returns ErrCrossDevice if tmp is not on the same mount as
+// dst, in which case renaming tmp to dst would fail. Since tmp is created in
+// dst's directory, this can only happen if dst already exists, for example as
+// a bind-mounted file. Mount IDs are compared rather than device numbers, as
+// overlayfs may report different devices for files that can be renamed over
+// each other. If mount IDs are not available, no check is performed.
+func checkSameMount(tmp *os.File, dst string) error {
+	_, err := os.Lstat(dst)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	tid, ok := mountIDOf(tmp.Name())
+	if !ok {
+		return nil
+	}
+	did, ok := mountIDOf(dst)
+	if !ok {
+		return nil
+	}
+	if tid != did {
+		return ErrCrossDevice
+	}
+	return nil
+}
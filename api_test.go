@@ -0,0 +1,62 @@
+package reflink
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSameMount(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	tmp, err := os.CreateTemp(d, "")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %s", err)
+		return
+	}
+	defer tmp.Close()
+
+	dst := filepath.Join(d, "dst.bin")
+	err = checkSameMount(tmp, dst)
+	if err != nil {
+		t.Errorf("checkSameMount failed with missing dst: %s", err)
+	}
+
+	err = os.WriteFile(dst, []byte("hello world"), 0666)
+	if err != nil {
+		t.Fatalf("failed to create destination file: %s", err)
+		return
+	}
+	err = checkSameMount(tmp, dst)
+	if err != nil {
+		t.Errorf("checkSameMount failed with existing dst: %s", err)
+	}
+
+	// simulate dst being on a different mount
+	defer func() { mountIDOf = mountID }()
+	mountIDOf = func(path string) (uint64, bool) {
+		if path == dst {
+			return 2, true
+		}
+		return 1, true
+	}
+	err = checkSameMount(tmp, dst)
+	if !errors.Is(err, ErrCrossDevice) {
+		t.Errorf("expected ErrCrossDevice on mount mismatch, got %v", err)
+	}
+
+	// unknown mount IDs skip the check
+	mountIDOf = func(path string) (uint64, bool) {
+		return 0, path != dst
+	}
+	err = checkSameMount(tmp, dst)
+	if err != nil {
+		t.Errorf("checkSameMount failed with unknown mount ID: %s", err)
+	}
+}
@@ -5,7 +5,20 @@ import "errors"
 // ErrReflinkUnsupported is returned by Always() if the operation is not
 // supported on the current operating system. Auto() will never return this
 // error.
+//
+// ErrLockContested is returned when Options.Lock is set and the destination is
+// already locked by another writer.
+//
+// ErrCrossDevice is returned when the temporary file created next to the
+// destination is not on the same mount as the destination, which would cause
+// the final rename to fail.
+//
+// ErrSeekUnsupported is returned when seeking relative to the end of a file
+// whose size cannot be determined.
 var (
 	ErrReflinkUnsupported = errors.New("reflink is not supported on this OS")
 	ErrReflinkFailed      = errors.New("reflink is not supported on this OS or file")
+	ErrLockContested      = errors.New("destination file is locked by another writer")
+	ErrCrossDevice        = errors.New("temporary file is not on the same mount as destination")
+	ErrSeekUnsupported    = errors.New("seek relative to end is not supported on this writer")
 )
@@ -0,0 +1,165 @@
+//go:build linux
+
+package reflink
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIEMAP definitions from linux/fiemap.h, not provided by x/sys/unix
+const (
+	fsIocFiemap = 0xc020660b // _IOWR('f', 11, struct fiemap)
+
+	fiemapFlagSync = 0x00000001
+
+	fiemapExtentLast        = 0x00000001
+	fiemapExtentUnknown     = 0x00000002
+	fiemapExtentDelalloc    = 0x00000004
+	fiemapExtentEncoded     = 0x00000008
+	fiemapExtentNotAligned  = 0x00000100
+	fiemapExtentDataInline  = 0x00000200
+	fiemapExtentUnwritten   = 0x00000800
+	fiemapExtentShared      = 0x00002000
+	fiemapExtentPhysUnknown = fiemapExtentUnknown | fiemapExtentDelalloc | fiemapExtentEncoded | fiemapExtentNotAligned | fiemapExtentDataInline | fiemapExtentUnwritten
+
+	fiemapBatch = 64 // number of extents fetched per ioctl call
+)
+
+// fiemapExtent matches struct fiemap_extent
+type fiemapExtent struct {
+	Logical    uint64
+	Physical   uint64
+	Length     uint64
+	reserved64 [2]uint64
+	Flags      uint32
+	reserved   [3]uint32
+}
+
+// fiemapRequest matches struct fiemap followed by fiemapBatch extents
+type fiemapRequest struct {
+	Start         uint64
+	Length        uint64
+	Flags         uint32
+	MappedExtents uint32
+	ExtentCount   uint32
+	reserved      uint32
+	Extents       [fiemapBatch]fiemapExtent
+}
+
+// fiemap returns the full list of extents for the given file, calling
+// FS_IOC_FIEMAP as many times as needed.
+func fiemap(f *os.File) ([]fiemapExtent, error) {
+	sf, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []fiemapExtent
+	req := &fiemapRequest{}
+	start := uint64(0)
+
+	for {
+		*req = fiemapRequest{
+			Start:       start,
+			Length:      ^uint64(0),
+			Flags:       fiemapFlagSync,
+			ExtentCount: fiemapBatch,
+		}
+
+		var errno unix.Errno
+		err = sf.Control(func(fd uintptr) {
+			_, _, errno = unix.Syscall(unix.SYS_IOCTL, fd, fsIocFiemap, uintptr(unsafe.Pointer(req)))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if errno != 0 {
+			if errno == unix.EOPNOTSUPP || errno == unix.ENOTTY {
+				return nil, ErrReflinkFailed
+			}
+			return nil, errno
+		}
+
+		if req.MappedExtents == 0 {
+			return res, nil
+		}
+		ext := req.Extents[:req.MappedExtents]
+		res = append(res, ext...)
+
+		last := ext[len(ext)-1]
+		if last.Flags&fiemapExtentLast != 0 {
+			return res, nil
+		}
+		start = last.Logical + last.Length
+	}
+}
+
+// sameExtents returns true if a and b map to the exact same physical extents,
+// meaning they share all their data. Physical addresses are only meaningful
+// within a single device, so files on different devices never match.
+func sameExtents(a, b *os.File) (bool, error) {
+	ast, err := a.Stat()
+	if err != nil {
+		return false, err
+	}
+	bst, err := b.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !sameDevice(ast, bst) {
+		return false, nil
+	}
+
+	ae, err := fiemap(a)
+	if err != nil {
+		return false, err
+	}
+	be, err := fiemap(b)
+	if err != nil {
+		return false, err
+	}
+	if len(ae) != len(be) {
+		return false, nil
+	}
+
+	for i := range ae {
+		x, y := ae[i], be[i]
+		if x.Flags&fiemapExtentPhysUnknown != 0 || y.Flags&fiemapExtentPhysUnknown != 0 {
+			// physical location of this extent isn't reliable
+			return false, nil
+		}
+		if x.Logical != y.Logical || x.Physical != y.Physical || x.Length != y.Length {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ReflinkInfo returns statistics on how much of f's data is shared with other
+// files (for example after a reflink operation) and how much is private.
+//
+// Extents are fetched with FIEMAP_FLAG_SYNC, and counted as shared when the
+// kernel sets FIEMAP_EXTENT_SHARED on them. There is no FIEMAP_FLAG_SHARED
+// request flag, sharing information is always returned when available. If the
+// filesystem does not support FIEMAP, ErrReflinkFailed is returned.
+func ReflinkInfo(f *os.File) (*FileInfo, error) {
+	ext, err := fiemap(f)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &FileInfo{TotalExtents: len(ext)}
+	for _, e := range ext {
+		if e.Flags&fiemapExtentShared != 0 {
+			res.SharedExtents += 1
+			res.SharedBytes += e.Length
+		} else {
+			res.PrivateExtents += 1
+			res.PrivateBytes += e.Length
+		}
+	}
+	return res, nil
+}
@@ -2,4 +2,4 @@ module github.com/KarpelesLab/reflink
 
 go 1.19
 
-require golang.org/x/sys v0.9.0 // indirect
+require golang.org/x/sys v0.9.0
@@ -0,0 +1,138 @@
+package reflink
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// CopyMethod describes the strategy that will be used to copy a file.
+type CopyMethod int
+
+const (
+	MethodUnknown       CopyMethod = iota // method could not be determined
+	MethodReflink                         // copy-on-write clone via FICLONE
+	MethodCopyFileRange                   // in-kernel copy via copy_file_range
+	MethodHardlink                        // src and dst already are the same file, nothing is copied
+	MethodIOCopy                          // plain userspace data copy
+	MethodSendfile                        // in-kernel copy via sendfile
+)
+
+// String returns a human readable name for the copy method
+func (m CopyMethod) String() string {
+	switch m {
+	case MethodReflink:
+		return "reflink"
+	case MethodCopyFileRange:
+		return "copy_file_range"
+	case MethodHardlink:
+		return "hardlink"
+	case MethodIOCopy:
+		return "io.Copy"
+	case MethodSendfile:
+		return "sendfile"
+	default:
+		return "unknown"
+	}
+}
+
+// DryRunResult is returned by ReflinkWithOptions when DryRun is set, and
+// describes what would have happened.
+type DryRunResult struct {
+	Src    string
+	Dst    string
+	Method CopyMethod
+}
+
+// PredictMethod returns the copy method that would be used to copy src into
+// dst with fallback enabled, without modifying either file.
+//
+// In order to test for reflink support, an empty temporary file is created
+// in dst's directory and removed before this function returns.
+func PredictMethod(src, dst string) (CopyMethod, error) {
+	sst, err := os.Stat(src)
+	if err != nil {
+		return MethodUnknown, err
+	}
+	dst, err = filepath.Abs(dst)
+	if err != nil {
+		return MethodUnknown, err
+	}
+
+	// if dst already is src (hardlink), there is nothing to copy
+	linked, err := alreadyLinked(sst, dst)
+	if err != nil {
+		return MethodUnknown, err
+	}
+	if linked {
+		return MethodHardlink, nil
+	}
+
+	ok, err := CanReflink(src, dst)
+	if err != nil {
+		return MethodUnknown, err
+	}
+	if ok {
+		return MethodReflink, nil
+	}
+
+	ok, err = canCopyFileRange(src, filepath.Dir(dst))
+	if err != nil {
+		return MethodUnknown, err
+	}
+	if ok {
+		return MethodCopyFileRange, nil
+	}
+
+	if canSendfile() {
+		return MethodSendfile, nil
+	}
+
+	return MethodIOCopy, nil
+}
+
+// alreadyLinked returns true if dst already is the same file as the source
+// file described by sst, in which case copying can be skipped.
+func alreadyLinked(sst fs.FileInfo, dst string) (bool, error) {
+	dstSt, err := os.Lstat(dst)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(sst, dstSt), nil
+}
+
+// CanReflink returns true if src can be reflinked into dst. dst does not need
+// to exist, but its directory does as a temporary file is created there in
+// order to perform the test. Errors meaning reflink is not possible between
+// these files (unsupported filesystem, different devices, etc) result in false
+// being returned without error, while any other error is returned as is.
+func CanReflink(src, dst string) (bool, error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer s.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = reflinkInternal(tmp, s)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, ErrReflinkFailed), errors.Is(err, ErrReflinkUnsupported),
+		errors.Is(err, syscall.EXDEV), errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.EINVAL):
+		return false, nil
+	default:
+		return false, err
+	}
+}
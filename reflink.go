@@ -2,7 +2,10 @@
 
 package reflink
 
-import "os"
+import (
+	"io/fs"
+	"os"
+)
 
 func reflinkInternal(d, s *os.File) error {
 	return ErrReflinkUnsupported
@@ -12,6 +15,58 @@ func reflinkRangeInternal(dst, src *os.File, dstOffset, srcOffset, n int64) erro
 	return ErrReflinkUnsupported
 }
 
-func copyFileRange(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, error) {
+// ReflinkFd performs a reflink operation on raw file descriptors. This is not
+// supported on this OS and will always return ErrReflinkUnsupported.
+func ReflinkFd(dstFd, srcFd uintptr) error {
+	return ErrReflinkUnsupported
+}
+
+// PartialFd performs a range reflink operation on raw file descriptors. This
+// is not supported on this OS and will always return ErrReflinkUnsupported.
+func PartialFd(dstFd, srcFd uintptr, dstOffset, srcOffset, n int64) error {
 	return ErrReflinkUnsupported
 }
+
+func copyFileRange(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, error) {
+	return 0, ErrReflinkUnsupported
+}
+
+func sendFileCopy(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, error) {
+	return 0, ErrReflinkUnsupported
+}
+
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
+
+func canSendfile() bool {
+	return false
+}
+
+func canCopyFileRange(src, dstDir string) (bool, error) {
+	return false, nil
+}
+
+func lockDestination(dst string) (func(), error) {
+	return nil, ErrReflinkUnsupported
+}
+
+func sameExtents(a, b *os.File) (bool, error) {
+	return false, ErrReflinkUnsupported
+}
+
+// ReflinkInfo returns extent sharing statistics for f. This is not supported
+// on this OS and will always return ErrReflinkUnsupported.
+func ReflinkInfo(f *os.File) (*FileInfo, error) {
+	return nil, ErrReflinkUnsupported
+}
+
+func mountID(path string) (uint64, bool) {
+	// not available, skip the check
+	return 0, false
+}
+
+func sameDevice(a, b fs.FileInfo) bool {
+	// no portable way to check, rename will fail if needed
+	return true
+}
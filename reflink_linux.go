@@ -4,7 +4,11 @@ package reflink
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -25,7 +29,7 @@ func reflinkInternal(d, s *os.File) error {
 	err = sd.Control(func(dfd uintptr) {
 		err2 = ss.Control(func(sfd uintptr) {
 			// int ioctl(int dest_fd, FICLONE, int src_fd);
-			err3 = unix.IoctlFileClone(int(dfd), int(sfd))
+			err3 = ReflinkFd(dfd, sfd)
 		})
 	})
 
@@ -38,10 +42,6 @@ func reflinkInternal(d, s *os.File) error {
 		return err2
 	}
 
-	if err3 != nil && errors.Is(err3, unix.ENOTSUP) {
-		return ErrReflinkFailed
-	}
-
 	// err3 is ioctl() response
 	return err3
 }
@@ -60,15 +60,8 @@ func reflinkRangeInternal(dst, src *os.File, dstOffset, srcOffset, n int64) erro
 
 	err = sd.Control(func(dfd uintptr) {
 		err2 = ss.Control(func(sfd uintptr) {
-			req := &unix.FileCloneRange{
-				Src_fd:      int64(sfd),
-				Src_offset:  uint64(srcOffset),
-				Src_length:  uint64(n),
-				Dest_offset: uint64(dstOffset),
-			}
-
-			// int ioctl(int dest_fd, FICLONE, int src_fd);
-			err3 = unix.IoctlFileCloneRange(int(dfd), req)
+			// int ioctl(int dest_fd, FICLONERANGE, struct file_clone_range *arg);
+			err3 = PartialFd(dfd, sfd, dstOffset, srcOffset, n)
 		})
 	})
 
@@ -80,14 +73,45 @@ func reflinkRangeInternal(dst, src *os.File, dstOffset, srcOffset, n int64) erro
 		// ss.Control failed
 		return err2
 	}
-	if err3 != nil && errors.Is(err3, unix.ENOTSUP) {
-		return ErrReflinkFailed
-	}
 
 	// err3 is ioctl() response
 	return err3
 }
 
+// ReflinkFd performs a reflink operation on raw file descriptors, replacing
+// dstFd's contents with srcFd. No fallback is attempted.
+//
+// The caller is responsible for keeping both file descriptors open for the
+// duration of the call, including making sure any *os.File owning them is not
+// garbage collected. Note that calling os.File.Fd() puts the file in blocking
+// mode as a side effect.
+func ReflinkFd(dstFd, srcFd uintptr) error {
+	err := unix.IoctlFileClone(int(dstFd), int(srcFd))
+	if err != nil && errors.Is(err, unix.ENOTSUP) {
+		return ErrReflinkFailed
+	}
+	return err
+}
+
+// PartialFd performs a range reflink operation on raw file descriptors. See
+// ReflinkFd for details on file descriptor lifetime.
+func PartialFd(dstFd, srcFd uintptr, dstOffset, srcOffset, n int64) error {
+	req := &unix.FileCloneRange{
+		Src_fd:      int64(srcFd),
+		Src_offset:  uint64(srcOffset),
+		Src_length:  uint64(n),
+		Dest_offset: uint64(dstOffset),
+	}
+	err := unix.IoctlFileCloneRange(int(dstFd), req)
+	if err != nil && errors.Is(err, unix.ENOTSUP) {
+		return ErrReflinkFailed
+	}
+	return err
+}
+
+// copyFileRange copies n bytes from src at srcOffset to dst at dstOffset using
+// copy_file_range. If src ends before n bytes could be copied,
+// io.ErrUnexpectedEOF is returned along with the number of bytes copied.
 func copyFileRange(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, error) {
 	ss, err := src.SyscallConn()
 	if err != nil {
@@ -98,26 +122,230 @@ func copyFileRange(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, err
 		return 0, err
 	}
 
-	var resN int
+	var total int64
 	var err2, err3 error
 
 	err = sd.Control(func(dfd uintptr) {
 		err2 = ss.Control(func(sfd uintptr) {
-			// call syscall
-			resN, err3 = unix.CopyFileRange(int(sfd), &srcOffset, int(dfd), &dstOffset, int(n), 0)
+			// copy_file_range may copy less than requested, loop until done
+			for total < n {
+				cnt := n - total
+				if cnt > 1<<30 {
+					cnt = 1 << 30
+				}
+				var resN int
+				resN, err3 = unix.CopyFileRange(int(sfd), &srcOffset, int(dfd), &dstOffset, int(cnt), 0)
+				if err3 != nil {
+					return
+				}
+				if resN == 0 {
+					err3 = io.ErrUnexpectedEOF
+					return
+				}
+				total += int64(resN)
+			}
 		})
 	})
 
 	if err != nil {
 		// sd.Control failed
-		return int64(resN), err
+		return total, err
 	}
 	if err2 != nil {
 		// ss.Control failed
-		return int64(resN), err2
+		return total, err2
 	}
 
-	// err3 is ioctl() response
-	return int64(resN), err3
+	// err3 is copy_file_range() response
+	return total, err3
+}
+
+// sendFileCopy copies n bytes from src at srcOffset to dst at dstOffset using
+// sendfile. Note that offsets are passed in the same order as copyFileRange
+// (dstOffset first), not as sendfile itself. dst's file offset is restored
+// once done.
+func sendFileCopy(dst, src *os.File, dstOffset, srcOffset, n int64) (int64, error) {
+	pos, err := dst.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Seek(pos, io.SeekStart)
+
+	// sendfile writes at the current offset of the output file
+	_, err = dst.Seek(dstOffset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	ss, err := src.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	sd, err := dst.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	var err2, err3 error
+
+	err = sd.Control(func(dfd uintptr) {
+		err2 = ss.Control(func(sfd uintptr) {
+			// sendfile may transfer less than requested, loop until done
+			for total < n {
+				cnt := n - total
+				if cnt > 1<<30 {
+					cnt = 1 << 30
+				}
+				var resN int
+				resN, err3 = unix.Sendfile(int(dfd), int(sfd), &srcOffset, int(cnt))
+				if err3 != nil {
+					return
+				}
+				if resN == 0 {
+					err3 = io.ErrUnexpectedEOF
+					return
+				}
+				total += int64(resN)
+			}
+		})
+	})
+
+	if err != nil {
+		// sd.Control failed
+		return total, err
+	}
+	if err2 != nil {
+		// ss.Control failed
+		return total, err2
+	}
+
+	// err3 is sendfile() response
+	return total, err3
+}
+
+// preallocate reserves size bytes of disk space for f using fallocate, so that
+// running out of space (or quota) is detected before any data is copied. f's
+// size is extended to size as a side effect. If the filesystem does not
+// support fallocate, nothing happens.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	sf, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err2 error
+	err = sf.Control(func(fd uintptr) {
+		err2 = unix.Fallocate(int(fd), 0, 0, size)
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case err2 == nil:
+		return nil
+	case errors.Is(err2, unix.ENOSPC), errors.Is(err2, unix.EDQUOT), errors.Is(err2, unix.EFBIG):
+		return fmt.Errorf("not enough space to copy %d bytes: %w", size, err2)
+	case errors.Is(err2, unix.EOPNOTSUPP), errors.Is(err2, unix.ENOTSUP), errors.Is(err2, unix.ENOSYS):
+		// fallocate not supported here, let the copy happen anyway
+		return nil
+	default:
+		return err2
+	}
+}
+
+// canSendfile returns true if sendfile can be used to copy files
+func canSendfile() bool {
+	return true
+}
+
+// canCopyFileRange checks if copy_file_range is expected to work between src
+// and a file created in dstDir. Since Linux 5.19, copy_file_range only works
+// between files on filesystems of the same type.
+func canCopyFileRange(src, dstDir string) (bool, error) {
+	var sfs, dfs unix.Statfs_t
+	if err := unix.Statfs(src, &sfs); err != nil {
+		return false, err
+	}
+	if err := unix.Statfs(dstDir, &dfs); err != nil {
+		return false, err
+	}
+	return sfs.Type == dfs.Type, nil
+}
+
+// lockDestination acquires an exclusive advisory lock on a ".lock" sidecar
+// file next to dst. The sidecar file is never removed, since removing it would
+// allow another writer to lock a new file with the same name while the old one
+// is still held. The returned function releases the lock.
+func lockDestination(dst string) (func(), error) {
+	fn := dst + ".lock"
+	f, err := os.OpenFile(fn, os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	sf, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var err2 error
+	err = sf.Control(func(fd uintptr) {
+		err2 = unix.Flock(int(fd), unix.LOCK_EX|unix.LOCK_NB)
+	})
+	if err == nil {
+		err = err2
+	}
+	if err != nil {
+		f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, ErrLockContested
+		}
+		return nil, err
+	}
+
+	// if the sidecar was removed or replaced while we were locking it, our lock
+	// is on a stale file and doesn't protect anything
+	fst, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pst, err := os.Stat(fn)
+	if err != nil || !os.SameFile(fst, pst) {
+		f.Close()
+		return nil, ErrLockContested
+	}
 
+	return func() {
+		f.Close() // closing the file releases the lock
+	}, nil
+}
+
+// mountID returns the mount ID of path using statx, or false if it could not
+// be obtained (requires Linux 5.8 or later).
+func mountID(path string) (uint64, bool) {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_MNT_ID, &stx)
+	if err != nil || stx.Mask&unix.STATX_MNT_ID == 0 {
+		return 0, false
+	}
+	return stx.Mnt_id, true
+}
+
+// sameDevice returns true if both files are on the same device
+func sameDevice(a, b fs.FileInfo) bool {
+	as, ok1 := a.Sys().(*syscall.Stat_t)
+	bs, ok2 := b.Sys().(*syscall.Stat_t)
+	if !ok1 || !ok2 {
+		// can't tell, assume it's fine
+		return true
+	}
+	return as.Dev == bs.Dev
 }
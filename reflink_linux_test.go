@@ -0,0 +1,179 @@
+//go:build linux
+
+package reflink
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockContested(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	src := filepath.Join(d, "src.bin")
+	err = os.WriteFile(src, []byte("hello world"), 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+	dst := filepath.Join(d, "dst.bin")
+
+	unlock, err := lockDestination(dst)
+	if err != nil {
+		t.Fatalf("failed to lock destination: %s", err)
+		return
+	}
+
+	_, err = ReflinkWithOptions(src, dst, Options{Fallback: true, Lock: true})
+	if !errors.Is(err, ErrLockContested) {
+		t.Errorf("expected ErrLockContested while lock is held, got %v", err)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		t.Errorf("destination was written while lock is held")
+	}
+
+	unlock()
+
+	_, err = ReflinkWithOptions(src, dst, Options{Fallback: true, Lock: true})
+	if err != nil {
+		t.Errorf("failed to run ReflinkWithOptions(Lock=true) after unlock: %s", err)
+	}
+}
+
+func TestSendFileCopy(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 64*1024)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	in, err := os.Open(filepath.Join(d, "src.bin"))
+	if err != nil {
+		t.Fatalf("failed to open source file for reading: %s", err)
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(d, "test.bin"))
+	if err != nil {
+		t.Fatalf("failed to create target file for writing: %s", err)
+		return
+	}
+	defer out.Close()
+
+	n, err := sendFileCopy(out, in, 1000, 3000, 20000)
+	if err != nil {
+		t.Fatalf("sendFileCopy failed: %s", err)
+		return
+	}
+	if n != 20000 {
+		t.Errorf("sendFileCopy copied %d bytes, expected 20000", n)
+	}
+	if pos, _ := out.Seek(0, io.SeekCurrent); pos != 0 {
+		t.Errorf("sendFileCopy moved dst offset to %d", pos)
+	}
+
+	data, err := os.ReadFile(filepath.Join(d, "test.bin"))
+	if err != nil {
+		t.Fatalf("failed to read target file: %s", err)
+		return
+	}
+	if len(data) != 21000 || !bytes.Equal(data[1000:], buf[3000:23000]) {
+		t.Errorf("sendFileCopy target file content does not match")
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	f, err := os.CreateTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %s", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = preallocate(f, 1024*1024)
+	if err != nil {
+		t.Fatalf("preallocate failed: %s", err)
+		return
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat file: %s", err)
+		return
+	}
+	if st.Size() != 1024*1024 {
+		t.Errorf("preallocate resulted in file size %d, expected %d", st.Size(), 1024*1024)
+	}
+}
+
+func TestCopyFileRangeShort(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 64*1024)
+	for i := range buf {
+		buf[i] = byte(i * 7)
+	}
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	in, err := os.Open(filepath.Join(d, "src.bin"))
+	if err != nil {
+		t.Fatalf("failed to open source file for reading: %s", err)
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(d, "test.bin"))
+	if err != nil {
+		t.Fatalf("failed to create target file for writing: %s", err)
+		return
+	}
+	defer out.Close()
+
+	n, err := copyFileRange(out, in, 0, 0, int64(len(buf)))
+	if err != nil {
+		t.Skipf("copy_file_range not available: %s", err)
+	}
+	if n != int64(len(buf)) {
+		t.Errorf("copyFileRange copied %d bytes, expected %d", n, len(buf))
+	}
+
+	// asking for more than src contains must not report success
+	n, err = copyFileRange(out, in, 0, 0, int64(len(buf))+1024)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF on short copy, got %v", err)
+	}
+	if n != int64(len(buf)) {
+		t.Errorf("short copyFileRange reported %d bytes, expected %d", n, len(buf))
+	}
+}
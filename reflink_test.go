@@ -116,3 +116,305 @@ func testOsFile(f *os.File, target []byte) error {
 	}
 	return nil
 }
+
+func TestPredictMethod(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	src := filepath.Join(d, "src.bin")
+	err = os.WriteFile(src, []byte("hello world"), 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	m, err := reflink.PredictMethod(src, filepath.Join(d, "dst.bin"))
+	if err != nil {
+		t.Errorf("failed to predict method: %s", err)
+	}
+	t.Logf("predicted method: %s", m)
+
+	res, err := reflink.ReflinkWithOptions(src, filepath.Join(d, "dst.bin"), reflink.Options{Fallback: true, DryRun: true})
+	if err != nil {
+		t.Errorf("failed to run ReflinkWithOptions(DryRun=true): %s", err)
+	} else if res == nil || res.Method != m {
+		t.Errorf("unexpected dry run result: %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(d, "dst.bin")); err == nil {
+		t.Errorf("dry run created destination file")
+	}
+	res, err = reflink.ReflinkWithOptions(src, filepath.Join(d, "dst.bin"), reflink.Options{DryRun: true})
+	if m == reflink.MethodReflink {
+		if err != nil || res == nil || res.Method != reflink.MethodReflink {
+			t.Errorf("unexpected dry run result without fallback: %+v %v", res, err)
+		}
+	} else if !errors.Is(err, reflink.ErrReflinkFailed) {
+		t.Errorf("dry run without fallback should fail with ErrReflinkFailed, got %+v %v", res, err)
+	}
+	if ents, _ := os.ReadDir(d); len(ents) != 1 {
+		t.Errorf("dry run left %d files in directory, expected 1", len(ents))
+	}
+
+	err = os.Link(src, filepath.Join(d, "link.bin"))
+	if err == nil {
+		m, err = reflink.PredictMethod(src, filepath.Join(d, "link.bin"))
+		if err != nil {
+			t.Errorf("failed to predict method: %s", err)
+		} else if m != reflink.MethodHardlink {
+			t.Errorf("expected MethodHardlink for hardlinked files, got %s", m)
+		}
+		res, err = reflink.ReflinkWithOptions(src, filepath.Join(d, "link.bin"), reflink.Options{DryRun: true})
+		if err != nil || res == nil || res.Method != reflink.MethodHardlink {
+			t.Errorf("unexpected dry run result without fallback for hardlinked files: %+v %v", res, err)
+		}
+
+		// a real copy must leave the link in place
+		err = reflink.Auto(src, filepath.Join(d, "link.bin"))
+		if err != nil {
+			t.Errorf("failed to reflink.Auto onto hardlink: %s", err)
+		}
+		sst, _ := os.Stat(src)
+		lst, _ := os.Stat(filepath.Join(d, "link.bin"))
+		if !os.SameFile(sst, lst) {
+			t.Errorf("reflink.Auto onto hardlink replaced the link")
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := []byte("hello world")
+	src := filepath.Join(d, "src.bin")
+	err = os.WriteFile(src, buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	dst := filepath.Join(d, "dst.bin")
+	// first run creates dst, second run replaces it
+	for i := 0; i < 2; i++ {
+		_, err = reflink.ReflinkWithOptions(src, dst, reflink.Options{Fallback: true, Lock: true})
+		if err != nil {
+			t.Fatalf("failed to run ReflinkWithOptions(Lock=true): %s", err)
+		}
+		err = testFile(dst, buf)
+		if err != nil {
+			t.Errorf("bad output file for ReflinkWithOptions(Lock=true): %s", err)
+		}
+		if _, err := os.Stat(dst + ".lock"); err != nil {
+			t.Errorf("lock sidecar file is missing: %s", err)
+		}
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 5*1024*1024) // 5MB, more than one chunk
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		t.Errorf("failed to fill test buffer with random bytes: %s", err)
+	}
+
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+	err = reflink.Auto(filepath.Join(d, "src.bin"), filepath.Join(d, "copy.bin"))
+	if err != nil {
+		t.Fatalf("failed to reflink.Auto: %s", err)
+		return
+	}
+	buf[len(buf)-1] ^= 0xff
+	err = os.WriteFile(filepath.Join(d, "diff.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create modified test file: %s", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(d, "short.bin"), buf[:1024], 0666)
+	if err != nil {
+		t.Fatalf("failed to create short test file: %s", err)
+		return
+	}
+
+	in, err := os.Open(filepath.Join(d, "src.bin"))
+	if err != nil {
+		t.Fatalf("failed to open source file for reading: %s", err)
+		return
+	}
+	defer in.Close()
+
+	for fn, expect := range map[string]bool{"copy.bin": true, "diff.bin": false, "short.bin": false} {
+		f, err := os.Open(filepath.Join(d, fn))
+		if err != nil {
+			t.Fatalf("failed to open %s for reading: %s", fn, err)
+			return
+		}
+		same, err := reflink.SameContent(in, f)
+		f.Close()
+		if err != nil {
+			t.Errorf("SameContent failed on %s: %s", fn, err)
+		} else if same != expect {
+			t.Errorf("SameContent on %s returned %v, expected %v", fn, same, expect)
+		}
+	}
+}
+
+func TestReflinkFd(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 1024*1024) // 1MB
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		t.Errorf("failed to fill test buffer with random bytes: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	in, err := os.Open(filepath.Join(d, "src.bin"))
+	if err != nil {
+		t.Fatalf("failed to open source file for reading: %s", err)
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(d, "test.bin"))
+	if err != nil {
+		t.Fatalf("failed to create target file for writing: %s", err)
+		return
+	}
+	defer out.Close()
+
+	err = reflink.ReflinkFd(out.Fd(), in.Fd())
+	if err != nil {
+		if errors.Is(err, reflink.ErrReflinkUnsupported) || errors.Is(err, reflink.ErrReflinkFailed) {
+			t.Skipf("cannot test reflink on this configuration: %s", err)
+		}
+		t.Fatalf("failed to reflink.ReflinkFd: %s", err)
+	}
+	err = testOsFile(out, buf)
+	if err != nil {
+		t.Errorf("ReflinkFd target file content fails: %s", err)
+	}
+}
+
+func TestReflinkInfo(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 1024*1024) // 1MB
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		t.Errorf("failed to fill test buffer with random bytes: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	in, err := os.Open(filepath.Join(d, "src.bin"))
+	if err != nil {
+		t.Fatalf("failed to open source file for reading: %s", err)
+		return
+	}
+	defer in.Close()
+
+	info, err := reflink.ReflinkInfo(in)
+	if err != nil {
+		if errors.Is(err, reflink.ErrReflinkUnsupported) || errors.Is(err, reflink.ErrReflinkFailed) {
+			t.Skipf("cannot test reflink info on this configuration: %s", err)
+		}
+		t.Fatalf("failed to reflink.ReflinkInfo: %s", err)
+	}
+	if info.SharedExtents+info.PrivateExtents != info.TotalExtents {
+		t.Errorf("inconsistent extent count: %+v", info)
+	}
+	if info.SharedBytes+info.PrivateBytes < uint64(len(buf)) {
+		t.Errorf("extents do not cover the whole file: %+v", info)
+	}
+}
+
+func TestAutoN(t *testing.T) {
+	d, err := os.MkdirTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(d)
+
+	buf := make([]byte, 1024*1024) // 1MB
+	_, err = io.ReadFull(rand.Reader, buf)
+	if err != nil {
+		t.Errorf("failed to fill test buffer with random bytes: %s", err)
+	}
+	err = os.WriteFile(filepath.Join(d, "src.bin"), buf, 0666)
+	if err != nil {
+		t.Fatalf("failed to create initial test file: %s", err)
+		return
+	}
+
+	dsts := []string{
+		filepath.Join(d, "test1.bin"),
+		filepath.Join(d, "test2.bin"),
+		filepath.Join(d, "missing", "test3.bin"), // directory does not exist
+		filepath.Join(d, "test4.bin"),
+	}
+	res := reflink.AutoN(filepath.Join(d, "src.bin"), dsts, 2)
+	if len(res) != len(dsts) {
+		t.Fatalf("AutoN returned %d results, expected %d", len(res), len(dsts))
+		return
+	}
+
+	for i, r := range res {
+		if r.Dst != dsts[i] {
+			t.Errorf("result %d is for %s, expected %s", i, r.Dst, dsts[i])
+		}
+		if i == 2 {
+			if r.Err == nil {
+				t.Errorf("AutoN to missing directory should have failed")
+			}
+			continue
+		}
+		if r.Err != nil {
+			t.Errorf("AutoN failed for %s: %s", r.Dst, r.Err)
+			continue
+		}
+		if r.BytesCopied != int64(len(buf)) {
+			t.Errorf("AutoN copied %d bytes to %s, expected %d", r.BytesCopied, r.Dst, len(buf))
+		}
+		err = testFile(r.Dst, buf)
+		if err != nil {
+			t.Errorf("bad output file for AutoN %s: %s", r.Dst, err)
+		}
+	}
+}
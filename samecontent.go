@@ -0,0 +1,105 @@
+package reflink
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// sameContentChunk is the size of data hashed at once by SameContent
+const sameContentChunk = 4 * 1024 * 1024
+
+// SameContent returns true if a and b have identical content. Files of
+// different sizes are never identical. On Linux the files' physical extents
+// are compared first, which allows detecting reflinked files without reading
+// them. Otherwise both files are read in parallel and compared 4MB at a time
+// using SHA-256.
+func SameContent(a, b *os.File) (bool, error) {
+	ast, err := a.Stat()
+	if err != nil {
+		return false, err
+	}
+	bst, err := b.Stat()
+	if err != nil {
+		return false, err
+	}
+	if ast.Size() != bst.Size() {
+		return false, nil
+	}
+	if os.SameFile(ast, bst) {
+		return true, nil
+	}
+
+	same, err := sameExtents(a, b)
+	if err == nil && same {
+		return true, nil
+	}
+
+	return sameHash(a, b, ast.Size())
+}
+
+type chunkSum struct {
+	sum [sha256.Size]byte
+	err error
+}
+
+// sameHash compares the SHA-256 of each chunk of a and b, reading both files
+// in parallel.
+func sameHash(a, b *os.File, size int64) (bool, error) {
+	done := make(chan struct{})
+	defer close(done)
+
+	ach := make(chan chunkSum, 1)
+	bch := make(chan chunkSum, 1)
+	go hashChunks(a, size, ach, done)
+	go hashChunks(b, size, bch, done)
+
+	for {
+		ar, aok := <-ach
+		br, bok := <-bch
+		if !aok || !bok {
+			// both channels are closed at the same time as long as no error happened
+			return aok == bok, nil
+		}
+		if ar.err != nil {
+			return false, ar.err
+		}
+		if br.err != nil {
+			return false, br.err
+		}
+		if ar.sum != br.sum {
+			return false, nil
+		}
+	}
+}
+
+// hashChunks sends the hash of each chunk of f to ch, and closes it on
+// completion. It stops early if an error happens or done is closed.
+func hashChunks(f *os.File, size int64, ch chan<- chunkSum, done <-chan struct{}) {
+	buf := make([]byte, sameContentChunk)
+
+	for off := int64(0); off < size; off += sameContentChunk {
+		n := size - off
+		if n > sameContentChunk {
+			n = sameContentChunk
+		}
+
+		var res chunkSum
+		_, err := io.ReadFull(io.NewSectionReader(f, off, n), buf[:n])
+		if err != nil {
+			res.err = err
+		} else {
+			res.sum = sha256.Sum256(buf[:n])
+		}
+
+		select {
+		case ch <- res:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+	close(ch)
+}
@@ -3,6 +3,7 @@ package reflink
 import (
 	"errors"
 	"io"
+	"io/fs"
 )
 
 // sectionWriter is a helper used when we need to fallback into copying data manually
@@ -26,8 +27,16 @@ func (s *sectionWriter) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		offset += s.off
 	case io.SeekEnd:
-		// we don't support io.SeekEnd
-		fallthrough
+		// we need to know the file's size for this
+		st, ok := s.w.(interface{ Stat() (fs.FileInfo, error) })
+		if !ok {
+			return s.off, ErrSeekUnsupported
+		}
+		fi, err := st.Stat()
+		if err != nil {
+			return s.off, err
+		}
+		offset += fi.Size() - s.base
 	default:
 		return s.off, errors.New("Seek: invalid whence")
 	}
@@ -0,0 +1,44 @@
+package reflink
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+type writerAtOnly struct{}
+
+func (writerAtOnly) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+func TestSectionWriterSeekEnd(t *testing.T) {
+	f, err := os.CreateTemp("", "reflinktest*")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %s", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatalf("failed to write temporary file: %s", err)
+		return
+	}
+
+	w := &sectionWriter{w: f, base: 100}
+	pos, err := w.Seek(-10, io.SeekEnd)
+	if err != nil {
+		t.Errorf("failed to seek from end: %s", err)
+	} else if pos != 890 {
+		t.Errorf("seek from end returned position %d, expected 890", pos)
+	}
+
+	w = &sectionWriter{w: writerAtOnly{}}
+	_, err = w.Seek(0, io.SeekEnd)
+	if !errors.Is(err, ErrSeekUnsupported) {
+		t.Errorf("expected ErrSeekUnsupported, got %v", err)
+	}
+}